@@ -6,12 +6,18 @@ package azure
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	mapset "github.com/deckarep/golang-set"
+	"golang.org/x/sync/errgroup"
 
 	uc "github.com/web-platform-tests/wpt.fyi/api/receiver/client"
 	"github.com/web-platform-tests/wpt.fyi/shared"
@@ -19,6 +25,32 @@ import (
 
 const uploaderName = "azure"
 
+// artifactUploadConcurrency bounds the number of artifacts uploaded in parallel
+// for a single build, so that a build with many artifacts cannot exhaust the
+// instance's outbound connection pool.
+const artifactUploadConcurrency = 4
+
+// newUploadClient constructs the receiver client used to create runs. It is a
+// variable so that tests can substitute a fake that injects transient failures.
+var newUploadClient = uc.NewClient
+
+// transientStatusRegex matches the receiver's error message for a 5xx response,
+// e.g. "...CreateRun returned HTTP status 503: ...".
+var transientStatusRegex = regexp.MustCompile(`\bstatus 5\d\d\b`)
+
+// isTransientUploadError reports whether err from uploadClient.CreateRun is
+// worth retrying: a network-level failure, or a 5xx from the receiver. A 4xx
+// (bad credentials, malformed payload) will fail identically on every attempt,
+// so it is treated as permanent instead of delaying the real failure by the
+// full retry budget.
+func isTransientUploadError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return transientStatusRegex.MatchString(err.Error())
+}
+
 // Labels for runs from Azure Pipelines are determined from the artifact names.
 // For master runs, artifact name may be either just "results" or something
 // like "safari-results".
@@ -70,55 +102,167 @@ func processBuild(
 		return false, fmt.Errorf("failed to unmarshal JSON: %w", err)
 	}
 
-	uploadedAny := false
-	errors := make(chan (error), artifacts.Count)
+	// Credentials are the same for every artifact in this build, so fetch them
+	// once rather than once per artifact.
+	uploader, err := aeAPI.GetUploader(uploaderName)
+	if err != nil {
+		return false, fmt.Errorf("failed to get uploader creds from Datastore: %w", err)
+	}
+
+	var (
+		mu          sync.Mutex
+		uploadedAny bool
+		uploadErrs  []error
+	)
+	g, ctx := errgroup.WithContext(aeAPI.Context())
+	g.SetLimit(artifactUploadConcurrency)
 	for _, artifact := range artifacts.Value {
+		artifact := artifact
 		if artifactName != "" && artifactName != artifact.Name {
 			log.Infof("Skipping artifact %s (looking for %s)", artifact.Name, artifactName)
 
 			continue
 		}
-		log.Infof("Uploading %s for %s/%s build %v...", artifact.Name, owner, repo, buildID)
 
-		labels := mapset.NewSet()
-		if sender != "" {
-			labels.Add(shared.GetUserLabel(sender))
-		}
+		g.Go(func() error {
+			log.Infof("Uploading %s for %s/%s build %v...", artifact.Name, owner, repo, buildID)
 
-		if masterRegex.MatchString(artifact.Name) {
-			if build.IsMasterBranch() || epochBranchesRegex.MatchString(build.SourceBranch) {
-				labels.Add(shared.MasterLabel)
+			labels := mapset.NewSet()
+			if sender != "" {
+				labels.Add(shared.GetUserLabel(sender))
 			}
-		} else if prHeadRegex.MatchString(artifact.Name) {
-			labels.Add(shared.PRHeadLabel)
-		} else if prBaseRegex.MatchString(artifact.Name) {
-			labels.Add(shared.PRBaseLabel)
-		}
 
-		uploader, err := aeAPI.GetUploader(uploaderName)
-		if err != nil {
-			return false, fmt.Errorf("failed to get uploader creds from Datastore: %w", err)
-		}
+			if masterRegex.MatchString(artifact.Name) {
+				if build.IsMasterBranch() || epochBranchesRegex.MatchString(build.SourceBranch) {
+					labels.Add(shared.MasterLabel)
+				}
+			} else if prHeadRegex.MatchString(artifact.Name) {
+				labels.Add(shared.PRHeadLabel)
+			} else if prBaseRegex.MatchString(artifact.Name) {
+				labels.Add(shared.PRBaseLabel)
+			}
 
-		uploadClient := uc.NewClient(aeAPI)
-		err = uploadClient.CreateRun(
-			sha,
-			uploader.Username,
-			uploader.Password,
-			// Azure has a single zip artifact, special-cased by the receiver.
-			[]string{artifact.Resource.DownloadURL},
-			nil,
-			shared.ToStringSlice(labels))
-		if err != nil {
-			errors <- fmt.Errorf("failed to create run: %w", err)
-		} else {
+			labelSlice := shared.ToStringSlice(labels)
+			uploadClient := newUploadClient(aeAPI)
+			err := shared.RetryWithBackoff(ctx, shared.DefaultRetryConfig, func() error {
+				uploadErr := uploadClient.CreateRun(
+					sha,
+					uploader.Username,
+					uploader.Password,
+					// Azure has a single zip artifact, special-cased by the receiver.
+					[]string{artifact.Resource.DownloadURL},
+					nil,
+					labelSlice)
+				if uploadErr != nil && !isTransientUploadError(uploadErr) {
+					return shared.Permanent(uploadErr)
+				}
+				return uploadErr
+			})
+
+			mu.Lock()
+			if err != nil {
+				uploadErrs = append(uploadErrs, fmt.Errorf("failed to create run for artifact %s: %w", artifact.Name, err))
+				mu.Unlock()
+				return nil
+			}
 			uploadedAny = true
-		}
-	}
-	close(errors)
-	for err := range errors {
-		return uploadedAny, err
+			mu.Unlock()
+
+			// Publish outside the critical section: it retries the run lookup
+			// (runLookupRetryConfig) and the publish itself (DefaultRetryConfig)
+			// with RetryWithBackoff, and holding the lock for that would serialize
+			// every concurrent upload behind it.
+			publishRunCreatedEvent(aeAPI, log, artifact.Name, sha, uploader.Username)
+			return nil
+		})
 	}
+	// Worker funcs always return nil so that one artifact's failure doesn't
+	// cancel the others' uploads via errgroup's context cancellation; errors
+	// are aggregated into uploadErrs instead.
+	_ = g.Wait()
 
+	if len(uploadErrs) > 0 {
+		return uploadedAny, aggregateErrors(uploadErrs)
+	}
 	return uploadedAny, nil
 }
+
+// aggregateErrors combines multiple artifact-upload errors into a single error
+// so that partial success (and each artifact's specific failure) is reported
+// accurately, rather than only the first error encountered.
+func aggregateErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("%d artifacts failed to upload:\n%s", len(errs), strings.Join(msgs, "\n"))
+}
+
+// artifactSuffixRegex strips the suffix that identifies an artifact's role
+// (master/PR-head/PR-base), leaving the product's browser name, e.g.
+// "chrome-results" -> "chrome". A bare "results"/"affected-tests" artifact (no
+// browser prefix) strips to "".
+var artifactSuffixRegex = regexp.MustCompile(`-?(results|affected-tests|affected-tests-without-changes)$`)
+
+// runLookupRetryConfig bounds how long publishRunCreatedEvent will poll for a
+// just-uploaded run to become visible, before giving up on publishing an event
+// for it. The receiver ingests uploads asynchronously, so the run commonly
+// isn't visible for a brief window right after CreateRun returns; this is not
+// an error case, so it is retried separately from shared.DefaultRetryConfig
+// (which governs the publish call itself, not this lookup).
+var runLookupRetryConfig = shared.RetryConfig{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    10 * time.Second,
+}
+
+// publishRunCreatedEvent fires the process-wide shared.RunEventPublisher for a
+// successfully uploaded run. uploadClient.CreateRun doesn't hand back the run
+// it created, so this looks the run up by product+SHA first, retrying for a
+// while if it isn't visible yet (the receiver ingests uploads asynchronously,
+// so this is an expected race, not a failure). If it's still not visible once
+// runLookupRetryConfig is exhausted, this logs and skips rather than publish an
+// event with a zero RunID/ResultsURL. Failures are logged, not returned, so a
+// downstream consumer outage can never fail an otherwise-successful upload.
+func publishRunCreatedEvent(aeAPI shared.AppEngineAPI, log shared.Logger, artifactName, sha, uploaderName string) {
+	browserName := artifactSuffixRegex.ReplaceAllString(artifactName, "")
+	if browserName == "" {
+		log.Debugf("Cannot determine product for artifact %s; skipping run-created event", artifactName)
+		return
+	}
+
+	ctx := aeAPI.Context()
+	publisher, err := shared.GetRunEventPublisher(ctx)
+	if err != nil {
+		log.Errorf("Failed to initialize run event publisher: %s", err.Error())
+		return
+	}
+
+	spec := shared.ProductSpec{ProductAtRevision: shared.ProductAtRevision{
+		Product:  shared.Product{BrowserName: browserName},
+		Revision: sha,
+	}}
+	var run *shared.TestRun
+	lookupErr := shared.RetryWithBackoff(ctx, runLookupRetryConfig, func() error {
+		found, err := shared.FetchRunForSpec(ctx, spec)
+		if err != nil {
+			return shared.Permanent(err)
+		}
+		if found == nil {
+			return fmt.Errorf("run %s@%s not yet ingested", browserName, sha)
+		}
+		run = found
+		return nil
+	})
+	if lookupErr != nil {
+		log.Errorf("Failed to fetch run %s@%s for run-created event: %s", browserName, sha, lookupErr.Error())
+		return
+	}
+
+	if err := publisher.PublishRunCreated(ctx, *run, uploaderName); err != nil {
+		log.Errorf("Failed to publish run-created event for %s@%s: %s", browserName, sha, err.Error())
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package azure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	uc "github.com/web-platform-tests/wpt.fyi/api/receiver/client"
+	"github.com/web-platform-tests/wpt.fyi/shared"
+)
+
+// fakeArtifactsRoundTripper serves a fixed JSON body for any request, standing
+// in for the Azure DevOps "list artifacts" endpoint.
+type fakeArtifactsRoundTripper struct {
+	body string
+}
+
+func (f fakeArtifactsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(f.body)),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func newFakeArtifactsHTTPClient(artifactsJSON string) *http.Client {
+	return &http.Client{Transport: fakeArtifactsRoundTripper{body: artifactsJSON}}
+}
+
+// fakeUploadClient fakes the receiver client, failing the first failCount
+// calls (to exercise retry) before succeeding, and recording the sha of every
+// call that succeeded.
+type fakeUploadClient struct {
+	mu        sync.Mutex
+	failCount int
+	calls     int
+	shas      []string
+}
+
+func (f *fakeUploadClient) CreateRun(sha, username, password string, resultsURL, rawResultsURL []string, labels []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failCount {
+		return fmt.Errorf("receiver returned HTTP status 503: temporarily unavailable")
+	}
+	f.shas = append(f.shas, sha)
+	return nil
+}
+
+// permanentFailUploadClient always fails with a non-retryable (4xx) error.
+type permanentFailUploadClient struct {
+	calls int
+}
+
+func (f *permanentFailUploadClient) CreateRun(sha, username, password string, resultsURL, rawResultsURL []string, labels []string) error {
+	f.calls++
+	return fmt.Errorf("receiver returned HTTP status 401: bad credentials")
+}
+
+// fakeAzureAPI fakes the Azure DevOps API, returning the same build for any
+// build ID. The artifact list is served by the fake HTTP client instead.
+type fakeAzureAPI struct {
+	build     *Build
+	artifacts BuildArtifacts
+}
+
+func (f fakeAzureAPI) GetBuild(owner, repo string, buildID int64) (*Build, error) {
+	return f.build, nil
+}
+
+func (f fakeAzureAPI) GetAzureArtifactsURL(owner, repo string, buildID int64) string {
+	return "https://example.com/artifacts"
+}
+
+// fakeAppEngineAPI fakes just enough of shared.AppEngineAPI for processBuild.
+type fakeAppEngineAPI struct {
+	shared.AppEngineAPI
+	httpClient *http.Client
+	uploader   shared.Uploader
+}
+
+func (f fakeAppEngineAPI) Context() context.Context {
+	return context.Background()
+}
+
+func (f fakeAppEngineAPI) GetHTTPClient() *http.Client {
+	return f.httpClient
+}
+
+func (f fakeAppEngineAPI) GetUploader(name string) (shared.Uploader, error) {
+	return f.uploader, nil
+}
+
+func newFakeAppEngineAPI(artifactsJSON string) fakeAppEngineAPI {
+	return fakeAppEngineAPI{
+		httpClient: newFakeArtifactsHTTPClient(artifactsJSON),
+		uploader:   shared.Uploader{Username: uploaderName, Password: "secret"},
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Speed up tests that exercise retry/backoff.
+	shared.DefaultRetryConfig = shared.RetryConfig{
+		MaxAttempts: 5,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    5 * time.Millisecond,
+	}
+	runLookupRetryConfig = shared.RetryConfig{
+		MaxAttempts: 2,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    5 * time.Millisecond,
+	}
+	os.Exit(m.Run())
+}
+
+func TestProcessBuild_RetriesTransientFailures(t *testing.T) {
+	fake := &fakeUploadClient{failCount: 2}
+	restore := newUploadClient
+	newUploadClient = func(aeAPI shared.AppEngineAPI) uc.API { return fake }
+	defer func() { newUploadClient = restore }()
+
+	aeAPI := newFakeAppEngineAPI(`{"count": 1, "value": [{"name": "chrome-results", "resource": {"downloadUrl": "https://example.com/a.zip"}}]}`)
+	azureAPI := fakeAzureAPI{build: &Build{TriggerInfo: TriggerInfo{SourceSHA: "abc123"}}}
+
+	uploaded, err := processBuild(aeAPI, azureAPI, "owner", "repo", "", "", 1)
+	assert.NoError(t, err)
+	assert.True(t, uploaded)
+	assert.Equal(t, 3, fake.calls)
+	assert.Equal(t, []string{"abc123"}, fake.shas)
+}
+
+func TestProcessBuild_AggregatesErrors(t *testing.T) {
+	fake := &fakeUploadClient{failCount: 100}
+	restore := newUploadClient
+	newUploadClient = func(aeAPI shared.AppEngineAPI) uc.API { return fake }
+	defer func() { newUploadClient = restore }()
+
+	aeAPI := newFakeAppEngineAPI(`{"count": 2, "value": [
+		{"name": "chrome-results", "resource": {"downloadUrl": "https://example.com/a.zip"}},
+		{"name": "firefox-results", "resource": {"downloadUrl": "https://example.com/b.zip"}}
+	]}`)
+	azureAPI := fakeAzureAPI{build: &Build{TriggerInfo: TriggerInfo{SourceSHA: "abc123"}}}
+
+	uploaded, err := processBuild(aeAPI, azureAPI, "owner", "repo", "", "", 1)
+	assert.Error(t, err)
+	assert.False(t, uploaded)
+	assert.Contains(t, err.Error(), "2 artifacts failed")
+}
+
+func TestAggregateErrors_SingleArtifactReturnsBareError(t *testing.T) {
+	inner := fmt.Errorf("artifact a failed")
+	assert.Equal(t, inner, aggregateErrors([]error{inner}))
+}
+
+func TestProcessBuild_DoesNotRetryPermanentFailures(t *testing.T) {
+	fake := &permanentFailUploadClient{}
+	restore := newUploadClient
+	newUploadClient = func(aeAPI shared.AppEngineAPI) uc.API { return fake }
+	defer func() { newUploadClient = restore }()
+
+	aeAPI := newFakeAppEngineAPI(`{"count": 1, "value": [{"name": "chrome-results", "resource": {"downloadUrl": "https://example.com/a.zip"}}]}`)
+	azureAPI := fakeAzureAPI{build: &Build{TriggerInfo: TriggerInfo{SourceSHA: "abc123"}}}
+
+	uploaded, err := processBuild(aeAPI, azureAPI, "owner", "repo", "", "", 1)
+	assert.Error(t, err)
+	assert.False(t, uploaded)
+	assert.Equal(t, 1, fake.calls, "a 4xx failure should not be retried")
+}
+
+func TestIsTransientUploadError(t *testing.T) {
+	assert.True(t, isTransientUploadError(fmt.Errorf("receiver returned HTTP status 503: unavailable")))
+	assert.True(t, isTransientUploadError(fmt.Errorf("receiver returned HTTP status 502: bad gateway")))
+	assert.False(t, isTransientUploadError(fmt.Errorf("receiver returned HTTP status 401: bad credentials")))
+	assert.False(t, isTransientUploadError(fmt.Errorf("receiver returned HTTP status 400: malformed sha")))
+}
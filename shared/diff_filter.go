@@ -0,0 +1,71 @@
+// Copyright 2020 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"net/url"
+	"strings"
+)
+
+// DiffFilterParam controls which kinds of results are included when diffing two
+// runs, and whether the diff additionally computes a subtest-level breakdown.
+type DiffFilterParam struct {
+	// Added includes paths present only in the 'after' run.
+	Added bool
+	// Deleted includes paths present only in the 'before' run.
+	Deleted bool
+	// Changed includes paths whose results differ between the two runs.
+	Changed bool
+	// Unchanged includes paths whose results are identical between the two runs.
+	Unchanged bool
+	// Subtests additionally computes a per-file subtest-level diff (see
+	// DiffAPI.GetRunsSubtestDiff), at the cost of fetching full per-file results.
+	Subtests bool
+	// ScoreFn, if set, is used by RunDiff.Ranked to rank regressed/improved paths.
+	// It is not reflected in String()/ParseDiffFilterParams, since a func value
+	// cannot round-trip through a query param; callers that want a non-default
+	// ScoreFn must set it directly on the DiffFilterParam they pass to GetRunsDiff.
+	ScoreFn ScoreFn
+}
+
+// String encodes filter as the wpt.fyi `filter` query param value: a string of
+// A/C/D/U letters for which categories of paths are included, plus a trailing
+// "S" when Subtests is set, e.g. "ACDS".
+func (f DiffFilterParam) String() string {
+	var s strings.Builder
+	if f.Added {
+		s.WriteString("A")
+	}
+	if f.Changed {
+		s.WriteString("C")
+	}
+	if f.Deleted {
+		s.WriteString("D")
+	}
+	if f.Unchanged {
+		s.WriteString("U")
+	}
+	if f.Subtests {
+		s.WriteString("S")
+	}
+	return s.String()
+}
+
+// ParseDiffFilterParams parses a DiffFilterParam from the "filter" query param (a
+// string of A/C/D/U/S letters, case-insensitive), defaulting to "ACD" (added,
+// changed, and deleted paths, no subtests) when the param is absent.
+func ParseDiffFilterParams(q url.Values) (filter DiffFilterParam, err error) {
+	code := q.Get("filter")
+	if code == "" {
+		code = "ACD"
+	}
+	code = strings.ToUpper(code)
+	filter.Added = strings.Contains(code, "A")
+	filter.Changed = strings.Contains(code, "C")
+	filter.Deleted = strings.Contains(code, "D")
+	filter.Unchanged = strings.Contains(code, "U")
+	filter.Subtests = strings.Contains(code, "S")
+	return filter, nil
+}
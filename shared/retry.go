@@ -0,0 +1,78 @@
+// Copyright 2020 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryConfig controls the exponential backoff used by RetryWithBackoff.
+type RetryConfig struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryConfig is a sensible default for retrying transient network failures,
+// such as uploads to external services or delivery of published events.
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts: 5,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// permanentError marks an error as non-retryable, so RetryWithBackoff gives up
+// immediately instead of retrying a failure that will never succeed.
+type permanentError struct {
+	err error
+}
+
+func (p *permanentError) Error() string { return p.err.Error() }
+func (p *permanentError) Unwrap() error { return p.err }
+
+// Permanent wraps err so that RetryWithBackoff treats it as non-retryable,
+// returning it as soon as fn returns it instead of retrying up to
+// cfg.MaxAttempts times.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// RetryWithBackoff calls fn until it succeeds, returns an error wrapped with
+// Permanent, ctx is done, or cfg.MaxAttempts is reached, sleeping for an
+// exponentially increasing, jittered delay between attempts. It returns nil on
+// success, ctx.Err() if ctx is done while waiting between attempts, and
+// otherwise the error from the final attempt (unwrapped, if it was Permanent).
+func RetryWithBackoff(ctx context.Context, cfg RetryConfig, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < cfg.MaxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if attempt == cfg.MaxAttempts-1 {
+			break
+		}
+		delay := cfg.BaseDelay * time.Duration(int64(1)<<uint(attempt))
+		if delay > cfg.MaxDelay {
+			delay = cfg.MaxDelay
+		}
+		jitter := time.Duration(rand.Int63n(int64(delay/2) + 1))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay/2 + jitter):
+		}
+	}
+	return err
+}
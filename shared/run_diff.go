@@ -23,6 +23,7 @@ import (
 // DiffAPI is an abstraction for computing run differences.
 type DiffAPI interface {
 	GetRunsDiff(before, after TestRun, filter DiffFilterParam, paths mapset.Set) (RunDiff, error)
+	GetRunsSubtestDiff(summary RunDiff, filter DiffFilterParam, paths mapset.Set) (RunSubtestDiff, error)
 	GetDiffURL(before, after TestRun, diffFilter *DiffFilterParam) *url.URL
 	GetMasterDiffURL(sha string, product ProductSpec) *url.URL
 }
@@ -84,6 +85,7 @@ type RunDiff struct {
 	AfterSummary  map[string][]int  `json:"-"`
 	Differences   map[string][]int  `json:"diff"`
 	Renames       map[string]string `json:"renames"`
+	scoreFn       ScoreFn
 }
 
 // FetchRunResultsJSONForParam fetches the results JSON blob for the given [product]@[SHA] param.
@@ -176,6 +178,7 @@ func (d diffAPIImpl) GetRunsDiff(before, after TestRun, filter DiffFilterParam,
 		AfterSummary:  afterJSON,
 		Differences:   GetResultsDiff(beforeJSON, afterJSON, filter, paths, renames),
 		Renames:       renames,
+		scoreFn:       filter.ScoreFn,
 	}, nil
 }
 
@@ -0,0 +1,111 @@
+// Copyright 2020 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"math"
+	"sort"
+)
+
+// ScoreFn computes a signed score for a single test file's [passed, total] result
+// counts before and after, used to rank files by how much they regressed or
+// improved. By convention, a positive score is an improvement and a negative
+// score is a regression; magnitude determines rank within each direction.
+type ScoreFn func(before, after []int) float64
+
+// AbsoluteDeltaScore scores by the raw change in passing-test count. It is the
+// default used by RunDiff.Ranked when no ScoreFn is set.
+func AbsoluteDeltaScore(before, after []int) float64 {
+	return float64(after[0] - before[0])
+}
+
+// RelativeDeltaScore scores by the change in pass rate, so that a 1/1 file which
+// starts failing ranks as badly as a 500/500 file which starts failing, instead
+// of being drowned out by it.
+func RelativeDeltaScore(before, after []int) float64 {
+	return passRate(after) - passRate(before)
+}
+
+// LogWeightedDeltaScore scores by the raw delta in passing tests, weighted by the
+// log of the file's size. For the same delta, a larger file ranks further from
+// zero than a smaller one; since the delta itself already grows with file size,
+// this weights large files even more heavily than AbsoluteDeltaScore does.
+func LogWeightedDeltaScore(before, after []int) float64 {
+	delta := float64(after[0] - before[0])
+	size := float64(max(before[1], after[1]))
+	return delta * math.Log1p(size)
+}
+
+func passRate(result []int) float64 {
+	if len(result) < 2 || result[1] == 0 {
+		return 0
+	}
+	return float64(result[0]) / float64(result[1])
+}
+
+// RankedDiff is a single entry in a Ranked diff listing: a test path together
+// with its raw [improved, regressed, total-delta] diff entry and the score used
+// to order it.
+type RankedDiff struct {
+	Path  string  `json:"path"`
+	Diff  []int   `json:"diff"`
+	Score float64 `json:"score"`
+}
+
+// Ranked returns the top limit regressed paths (most negative score first),
+// followed by the top limit improved paths (most positive score first),
+// according to the DiffFilterParam.ScoreFn that produced d (AbsoluteDeltaScore
+// if none was set). It lets callers request a bounded, pre-sorted diff instead
+// of downloading the full Differences map, which materially reduces payload
+// size for the diff view on large runs.
+func (d RunDiff) Ranked(limit int) []RankedDiff {
+	if limit <= 0 {
+		return nil
+	}
+
+	scoreFn := d.scoreFn
+	if scoreFn == nil {
+		scoreFn = AbsoluteDeltaScore
+	}
+
+	all := make([]RankedDiff, 0, len(d.Differences))
+	for path, delta := range d.Differences {
+		before, ok := d.BeforeSummary[path]
+		if !ok {
+			before = []int{0, 0}
+		}
+		after, ok := d.AfterSummary[path]
+		if !ok {
+			after = []int{0, 0}
+		}
+		all = append(all, RankedDiff{
+			Path:  path,
+			Diff:  delta,
+			Score: scoreFn(before, after),
+		})
+	}
+
+	var regressed, improved []RankedDiff
+	for _, r := range all {
+		switch {
+		case r.Score < 0:
+			regressed = append(regressed, r)
+		case r.Score > 0:
+			improved = append(improved, r)
+		}
+	}
+
+	sort.Slice(regressed, func(i, j int) bool { return regressed[i].Score < regressed[j].Score })
+	if len(regressed) > limit {
+		regressed = regressed[:limit]
+	}
+
+	sort.Slice(improved, func(i, j int) bool { return improved[i].Score > improved[j].Score })
+	if len(improved) > limit {
+		improved = improved[:limit]
+	}
+
+	return append(regressed, improved...)
+}
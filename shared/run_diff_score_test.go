@@ -0,0 +1,88 @@
+// Copyright 2020 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunDiff_Ranked(t *testing.T) {
+	diff := RunDiff{
+		BeforeSummary: map[string][]int{
+			"/a.html": {1, 1},
+			"/b.html": {1, 500},
+			"/c.html": {500, 500},
+		},
+		AfterSummary: map[string][]int{
+			"/a.html": {0, 1},
+			"/b.html": {2, 500},
+			"/c.html": {495, 500},
+		},
+		Differences: map[string][]int{
+			"/a.html": {0, 1, 0},
+			"/b.html": {1, 0, 0},
+			"/c.html": {0, 5, 0},
+		},
+	}
+
+	t.Run("AbsoluteDeltaScore ranks by raw count", func(t *testing.T) {
+		diff.scoreFn = AbsoluteDeltaScore
+		ranked := diff.Ranked(1)
+		assert.Len(t, ranked, 2)
+		assert.Equal(t, "/c.html", ranked[0].Path)
+		assert.Equal(t, "/b.html", ranked[1].Path)
+	})
+
+	t.Run("RelativeDeltaScore ranks a fully-failing tiny file worst", func(t *testing.T) {
+		diff.scoreFn = RelativeDeltaScore
+		ranked := diff.Ranked(1)
+		assert.Len(t, ranked, 2)
+		assert.Equal(t, "/a.html", ranked[0].Path)
+	})
+
+	t.Run("nil scoreFn defaults to AbsoluteDeltaScore", func(t *testing.T) {
+		diff.scoreFn = nil
+		ranked := diff.Ranked(3)
+		assert.Equal(t, AbsoluteDeltaScore([]int{500, 500}, []int{495, 500}), ranked[0].Score)
+	})
+
+	t.Run("limit larger than either direction's count does not duplicate or cross over", func(t *testing.T) {
+		diff.scoreFn = AbsoluteDeltaScore
+		ranked := diff.Ranked(3)
+		// Only 2 regressions (/c.html, /a.html) and 1 improvement (/b.html) exist;
+		// a limit of 3 must not pad either side with entries from the other sign,
+		// and no path should appear twice.
+		assert.Len(t, ranked, 3)
+		seen := map[string]int{}
+		for _, r := range ranked {
+			seen[r.Path]++
+		}
+		for path, count := range seen {
+			assert.Equal(t, 1, count, "path %s appeared more than once", path)
+		}
+		assert.Equal(t, []string{"/c.html", "/a.html", "/b.html"},
+			[]string{ranked[0].Path, ranked[1].Path, ranked[2].Path})
+		for _, r := range ranked[:2] {
+			assert.Less(t, r.Score, float64(0), "regressed half must only contain regressions")
+		}
+		assert.Greater(t, ranked[2].Score, float64(0), "improved half must only contain improvements")
+	})
+
+	t.Run("negative limit does not panic and returns no results", func(t *testing.T) {
+		diff.scoreFn = AbsoluteDeltaScore
+		assert.NotPanics(t, func() {
+			ranked := diff.Ranked(-1)
+			assert.Nil(t, ranked)
+		})
+	})
+}
+
+func TestLogWeightedDeltaScore_FavorsLargerFiles(t *testing.T) {
+	small := LogWeightedDeltaScore([]int{1, 1}, []int{0, 1})
+	large := LogWeightedDeltaScore([]int{500, 500}, []int{499, 500})
+	assert.Less(t, large, small)
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/appengine"
+)
+
+// RunEvent is the structured payload published whenever a test run is
+// successfully created, so that downstream systems (feature-status dashboards,
+// interop scoring, external consumers) can react without polling /api/runs.
+type RunEvent struct {
+	RunID          int64       `json:"run_id"`
+	Product        ProductSpec `json:"product"`
+	Revision       string      `json:"revision"`
+	Labels         []string    `json:"labels"`
+	ResultsURL     string      `json:"results_url"`
+	Uploader       string      `json:"uploader"`
+	IdempotencyKey string      `json:"idempotency_key"`
+}
+
+// RunEventTransport delivers a RunEvent to a downstream subscriber.
+type RunEventTransport interface {
+	Publish(ctx context.Context, event RunEvent) error
+}
+
+// RunEventPublisher publishes a RunEvent whenever a run is successfully created,
+// retrying transient transport failures with exponential backoff.
+type RunEventPublisher struct {
+	transport RunEventTransport
+}
+
+var (
+	runEventPublisherMu sync.Mutex
+	runEventPublisher   *RunEventPublisher
+)
+
+// GetRunEventPublisher returns a process-wide RunEventPublisher, constructing it
+// (via NewRunEventPublisher) on first call and caching the result, so that a
+// persistent transport like a Pub/Sub client is dialed once per instance rather
+// than once per published event. Only a successful construction is cached: if
+// NewRunEventPublisher fails (e.g. a transient dial error during an instance's
+// cold start), the next call retries construction instead of returning the same
+// error for the rest of the instance's lifetime.
+func GetRunEventPublisher(ctx context.Context) (*RunEventPublisher, error) {
+	runEventPublisherMu.Lock()
+	defer runEventPublisherMu.Unlock()
+	if runEventPublisher != nil {
+		return runEventPublisher, nil
+	}
+	publisher, err := NewRunEventPublisher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	runEventPublisher = publisher
+	return runEventPublisher, nil
+}
+
+// getRunEventSecret and newPubsubTransport are variables so that tests can
+// substitute fakes for NewRunEventPublisher's transport-selection logic,
+// without needing Datastore or a live Pub/Sub dial.
+var (
+	getRunEventSecret  = GetSecret
+	newPubsubTransport = func(ctx context.Context, topicName string) (RunEventTransport, error) {
+		return newPubsubRunEventTransport(ctx, topicName)
+	}
+)
+
+// NewRunEventPublisher selects a transport from Datastore secrets: a GCP Pub/Sub
+// topic in production ("run-events-pubsub-topic"), falling back to an HTTP
+// webhook for local dev and tests ("run-events-webhook-url"). If neither secret
+// is set, events are silently dropped so that ingestion is never blocked on a
+// missing consumer. Most callers should use GetRunEventPublisher instead, so
+// that a transport backed by a persistent connection (e.g. Pub/Sub) is only
+// ever constructed once.
+func NewRunEventPublisher(ctx context.Context) (*RunEventPublisher, error) {
+	if topicName, err := getRunEventSecret(ctx, "run-events-pubsub-topic"); err == nil && topicName != "" {
+		transport, err := newPubsubTransport(ctx, topicName)
+		if err != nil {
+			return nil, err
+		}
+		return NewRunEventPublisherWithTransport(transport), nil
+	}
+	if webhookURL, err := getRunEventSecret(ctx, "run-events-webhook-url"); err == nil && webhookURL != "" {
+		return NewRunEventPublisherWithTransport(newWebhookRunEventTransport(webhookURL)), nil
+	}
+	return NewRunEventPublisherWithTransport(noopRunEventTransport{}), nil
+}
+
+// NewRunEventPublisherWithTransport constructs a RunEventPublisher backed by an
+// explicit transport, for use in tests or callers with a non-Secret-based config.
+func NewRunEventPublisherWithTransport(transport RunEventTransport) *RunEventPublisher {
+	return &RunEventPublisher{transport: transport}
+}
+
+// Close releases any resources held by the publisher's transport, such as a
+// Pub/Sub client's underlying gRPC connection. It is a no-op for transports
+// that hold nothing worth closing.
+func (p *RunEventPublisher) Close() error {
+	if closer, ok := p.transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// PublishRunCreated publishes a RunEvent for run, uploaded by uploader, retrying
+// transient delivery failures with exponential backoff. The idempotency key is
+// derived from (sha, product, uploader) so consumers can dedupe redelivered events.
+func (p *RunEventPublisher) PublishRunCreated(ctx context.Context, run TestRun, uploader string) error {
+	event := RunEvent{
+		RunID:          run.ID,
+		Product:        ProductSpec{ProductAtRevision: run.ProductAtRevision},
+		Revision:       run.FullRevisionHash,
+		Labels:         run.Labels,
+		ResultsURL:     run.ResultsURL,
+		Uploader:       uploader,
+		IdempotencyKey: runEventIdempotencyKey(run.FullRevisionHash, run.ProductAtRevision.String(), uploader),
+	}
+	return RetryWithBackoff(ctx, DefaultRetryConfig, func() error {
+		return p.transport.Publish(ctx, event)
+	})
+}
+
+func runEventIdempotencyKey(sha, product, uploader string) string {
+	sum := sha256.Sum256([]byte(sha + "|" + product + "|" + uploader))
+	return hex.EncodeToString(sum[:])
+}
+
+// noopRunEventTransport drops events, used when no transport is configured.
+type noopRunEventTransport struct{}
+
+func (noopRunEventTransport) Publish(ctx context.Context, event RunEvent) error {
+	return nil
+}
+
+// pubsubRunEventTransport publishes events to a GCP Pub/Sub topic.
+type pubsubRunEventTransport struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+}
+
+func newPubsubRunEventTransport(ctx context.Context, topicName string) (*pubsubRunEventTransport, error) {
+	client, err := pubsub.NewClient(ctx, appengine.AppID(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Pub/Sub client: %w", err)
+	}
+	return &pubsubRunEventTransport{client: client, topic: client.Topic(topicName)}, nil
+}
+
+// Close closes the underlying Pub/Sub client's gRPC connection.
+func (t *pubsubRunEventTransport) Close() error {
+	return t.client.Close()
+}
+
+func (t *pubsubRunEventTransport) Publish(ctx context.Context, event RunEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	result := t.topic.Publish(ctx, &pubsub.Message{
+		Data:       data,
+		Attributes: map[string]string{"idempotency_key": event.IdempotencyKey},
+	})
+	_, err = result.Get(ctx)
+	return err
+}
+
+// webhookRunEventTransport POSTs events as JSON to a fixed URL, for local dev and
+// tests, and for consumers modeled on the wpt-consumer webhook pattern.
+type webhookRunEventTransport struct {
+	url string
+}
+
+func newWebhookRunEventTransport(url string) *webhookRunEventTransport {
+	return &webhookRunEventTransport{url: url}
+}
+
+func (t *webhookRunEventTransport) Publish(ctx context.Context, event RunEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Idempotency-Key", event.IdempotencyKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned HTTP status %d", t.url, resp.StatusCode)
+	}
+	return nil
+}
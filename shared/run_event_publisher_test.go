@@ -0,0 +1,143 @@
+// Copyright 2020 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withFakeRunEventSecrets(t *testing.T, secrets map[string]string, pubsubTransport RunEventTransport, pubsubErr error) {
+	restoreSecret := getRunEventSecret
+	restorePubsub := newPubsubTransport
+	getRunEventSecret = func(ctx context.Context, name string) (string, error) {
+		value, ok := secrets[name]
+		if !ok {
+			return "", nil
+		}
+		return value, nil
+	}
+	newPubsubTransport = func(ctx context.Context, topicName string) (RunEventTransport, error) {
+		return pubsubTransport, pubsubErr
+	}
+	t.Cleanup(func() {
+		getRunEventSecret = restoreSecret
+		newPubsubTransport = restorePubsub
+	})
+}
+
+func TestNewRunEventPublisher_PrefersPubsubWhenConfigured(t *testing.T) {
+	fake := &recordingTransport{}
+	withFakeRunEventSecrets(t, map[string]string{
+		"run-events-pubsub-topic": "my-topic",
+		"run-events-webhook-url":  "https://example.com/webhook",
+	}, fake, nil)
+
+	publisher, err := NewRunEventPublisher(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, fake, publisher.transport)
+}
+
+func TestNewRunEventPublisher_FallsBackToWebhookWithoutPubsubTopic(t *testing.T) {
+	withFakeRunEventSecrets(t, map[string]string{
+		"run-events-webhook-url": "https://example.com/webhook",
+	}, nil, nil)
+
+	publisher, err := NewRunEventPublisher(context.Background())
+	assert.NoError(t, err)
+	webhook, ok := publisher.transport.(*webhookRunEventTransport)
+	assert.True(t, ok, "expected *webhookRunEventTransport, got %T", publisher.transport)
+	assert.Equal(t, "https://example.com/webhook", webhook.url)
+}
+
+func TestNewRunEventPublisher_FallsBackToNoopWithNeitherSecretSet(t *testing.T) {
+	withFakeRunEventSecrets(t, map[string]string{}, nil, nil)
+
+	publisher, err := NewRunEventPublisher(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, noopRunEventTransport{}, publisher.transport)
+}
+
+// recordingTransport is a RunEventTransport fake that records the events it
+// was asked to publish.
+type recordingTransport struct {
+	events []RunEvent
+}
+
+func (r *recordingTransport) Publish(ctx context.Context, event RunEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestWebhookRunEventTransport_PublishSendsJSONWithIdempotencyHeader(t *testing.T) {
+	var (
+		gotMethod  string
+		gotHeader  string
+		gotContent string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotHeader = r.Header.Get("X-Idempotency-Key")
+		gotContent = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := newWebhookRunEventTransport(server.URL)
+	event := RunEvent{RunID: 1, IdempotencyKey: "abc123"}
+	err := transport.Publish(context.Background(), event)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.MethodPost, gotMethod)
+	assert.Equal(t, "abc123", gotHeader)
+	assert.Equal(t, "application/json", gotContent)
+}
+
+func TestWebhookRunEventTransport_PublishReturnsErrorOnFailureStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	transport := newWebhookRunEventTransport(server.URL)
+	err := transport.Publish(context.Background(), RunEvent{})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "500")
+}
+
+func TestRunEventIdempotencyKey_DeterministicAndSensitiveToEachInput(t *testing.T) {
+	key := runEventIdempotencyKey("sha1", "chrome", "azure")
+	assert.Equal(t, key, runEventIdempotencyKey("sha1", "chrome", "azure"))
+	assert.NotEqual(t, key, runEventIdempotencyKey("sha2", "chrome", "azure"))
+	assert.NotEqual(t, key, runEventIdempotencyKey("sha1", "firefox", "azure"))
+	assert.NotEqual(t, key, runEventIdempotencyKey("sha1", "chrome", "github-actions"))
+}
+
+func TestGetRunEventPublisher_DoesNotCacheConstructionErrors(t *testing.T) {
+	restore := runEventPublisher
+	runEventPublisher = nil
+	t.Cleanup(func() { runEventPublisher = restore })
+
+	withFakeRunEventSecrets(t, map[string]string{
+		"run-events-pubsub-topic": "my-topic",
+	}, nil, assert.AnError)
+
+	_, err := GetRunEventPublisher(context.Background())
+	assert.Error(t, err)
+
+	fake := &recordingTransport{}
+	withFakeRunEventSecrets(t, map[string]string{
+		"run-events-pubsub-topic": "my-topic",
+	}, fake, nil)
+
+	publisher, err := GetRunEventPublisher(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, fake, publisher.transport)
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	mapset "github.com/deckarep/golang-set"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// subtestFetchConcurrency bounds the number of per-file result JSON blobs that are
+// fetched in parallel when computing a subtest-level diff, so that a full-run diff
+// over ~20k files stays memory-bounded.
+const subtestFetchConcurrency = 10
+
+// SubtestDiff captures the subtest-level changes for a single test file between
+// two runs.
+type SubtestDiff struct {
+	NewlyPassing []string `json:"newly_passing"`
+	NewlyFailing []string `json:"newly_failing"`
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+}
+
+// RunSubtestDiff is a map from test-path to the SubtestDiff for that path.
+type RunSubtestDiff map[string]SubtestDiff
+
+// subtestResult is the subset of a per-file wpt-results report that this package
+// cares about: the name and status of each subtest.
+type subtestResult struct {
+	Subtests []struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+	} `json:"subtests"`
+}
+
+// GetRunsSubtestDiff computes a subtest-level diff for the files that summary
+// identifies as changed (i.e. summary.Differences), honoring the same paths
+// prefix filter and renames map that were used to produce summary, so that a
+// renamed file's before/after results are compared against each other rather
+// than reported as wholly added/removed. It is a no-op unless filter.Subtests
+// is set, since it is far more expensive than the summary-only GetRunsDiff.
+func (d diffAPIImpl) GetRunsSubtestDiff(summary RunDiff, filter DiffFilterParam, paths mapset.Set) (RunSubtestDiff, error) {
+	if !filter.Subtests {
+		return nil, nil
+	}
+
+	diff := make(RunSubtestDiff)
+	var mu sync.Mutex
+
+	g, ctx := errgroup.WithContext(d.ctx)
+	g.SetLimit(subtestFetchConcurrency)
+	for test := range summary.Differences {
+		test := test
+		if !anyPathMatches(paths, test) {
+			continue
+		}
+		g.Go(func() error {
+			beforeTest := test
+			if was, ok := reverseRename(summary.Renames, test); ok {
+				beforeTest = was
+			}
+			// A path only appears in one side's summary when it was added or
+			// removed (e.g. surfaced by filter.Added/filter.Deleted); fetching the
+			// missing side would just 404, so skip it and treat it as empty.
+			_, hasBefore := summary.BeforeSummary[beforeTest]
+			_, hasAfter := summary.AfterSummary[test]
+
+			beforeStatus := map[string]string{}
+			if hasBefore {
+				result, err := fetchSubtestResult(ctx, summary.Before, beforeTest)
+				if err != nil {
+					return fmt.Errorf("failed to fetch 'before' subtests for %s: %w", test, err)
+				}
+				beforeStatus = statusesByName(result)
+			}
+			afterStatus := map[string]string{}
+			if hasAfter {
+				result, err := fetchSubtestResult(ctx, summary.After, test)
+				if err != nil {
+					return fmt.Errorf("failed to fetch 'after' subtests for %s: %w", test, err)
+				}
+				afterStatus = statusesByName(result)
+			}
+
+			subtestDiff := diffSubtestStatuses(beforeStatus, afterStatus)
+			if subtestDiff == nil {
+				return nil
+			}
+			mu.Lock()
+			diff[test] = *subtestDiff
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// reverseRename looks up the pre-rename path for a (possibly renamed) test path.
+func reverseRename(renames map[string]string, test string) (string, bool) {
+	for was, is := range renames {
+		if is == test {
+			return was, true
+		}
+	}
+	return "", false
+}
+
+// statusesByName flattens a subtestResult into a map of subtest name to status.
+func statusesByName(result *subtestResult) map[string]string {
+	statuses := make(map[string]string, len(result.Subtests))
+	for _, s := range result.Subtests {
+		statuses[s.Name] = s.Status
+	}
+	return statuses
+}
+
+// diffSubtestStatuses aligns subtest names between before and after (either of
+// which may be empty, for a file that was wholly added or removed) and returns
+// the subtests that newly pass, newly fail, were added, or were removed. It
+// returns nil if there is no difference at all.
+func diffSubtestStatuses(before, after map[string]string) *SubtestDiff {
+	result := SubtestDiff{}
+	for name, was := range before {
+		is, ok := after[name]
+		if !ok {
+			result.Removed = append(result.Removed, name)
+			continue
+		}
+		if was != "PASS" && is == "PASS" {
+			result.NewlyPassing = append(result.NewlyPassing, name)
+		} else if was == "PASS" && is != "PASS" {
+			result.NewlyFailing = append(result.NewlyFailing, name)
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			result.Added = append(result.Added, name)
+		}
+	}
+	if len(result.NewlyPassing) == 0 && len(result.NewlyFailing) == 0 &&
+		len(result.Added) == 0 && len(result.Removed) == 0 {
+		return nil
+	}
+	return &result
+}
+
+// subtestHTTPClient returns the HTTP client used to fetch per-file subtest
+// results. It is a variable so tests can substitute a fake transport.
+var subtestHTTPClient = urlfetch.Client
+
+// fetchSubtestResult fetches the full (per-subtest) result JSON for a single test file
+// in run. Per-file reports are stored as siblings of the summary at run.ResultsURL,
+// keyed by test path, so e.g. ".../foo-summary.json" + "/a/b.html" becomes
+// ".../foo/a/b.html.json".
+func fetchSubtestResult(ctx context.Context, run TestRun, test string) (*subtestResult, error) {
+	url := strings.TrimSuffix(run.ResultsURL, "-summary.json") + test + ".json"
+
+	client := subtestHTTPClient(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned HTTP status %d:\n%s", url, resp.StatusCode, string(body))
+	}
+
+	var result subtestResult
+	if err = json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
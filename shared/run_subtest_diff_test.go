@@ -0,0 +1,85 @@
+// Copyright 2020 The WPT Dashboard Project. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package shared
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSubtestStatuses(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after map[string]string
+		want          *SubtestDiff
+	}{
+		{"unchanged", map[string]string{"a": "PASS"}, map[string]string{"a": "PASS"}, nil},
+		{"newly passing", map[string]string{"a": "FAIL"}, map[string]string{"a": "PASS"}, &SubtestDiff{NewlyPassing: []string{"a"}}},
+		{"newly failing", map[string]string{"a": "PASS"}, map[string]string{"a": "FAIL"}, &SubtestDiff{NewlyFailing: []string{"a"}}},
+		{"added", map[string]string{}, map[string]string{"a": "PASS"}, &SubtestDiff{Added: []string{"a"}}},
+		{"removed", map[string]string{"a": "PASS"}, map[string]string{}, &SubtestDiff{Removed: []string{"a"}}},
+		{"both empty", map[string]string{}, map[string]string{}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, diffSubtestStatuses(tc.before, tc.after))
+		})
+	}
+}
+
+// roundTripFunc adapts a function to http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func jsonResponse(body string) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func TestGetRunsSubtestDiff_SkipsFetchingMissingSide(t *testing.T) {
+	restore := subtestHTTPClient
+	defer func() { subtestHTTPClient = restore }()
+
+	var fetchedURLs []string
+	subtestHTTPClient = func(ctx context.Context) *http.Client {
+		return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			fetchedURLs = append(fetchedURLs, req.URL.String())
+			return jsonResponse(`{"subtests": [{"name": "sub1", "status": "PASS"}]}`)
+		})}
+	}
+
+	d := diffAPIImpl{ctx: context.Background()}
+	summary := RunDiff{
+		Before:        TestRun{ResultsURL: "https://example.com/chrome-summary.json"},
+		After:         TestRun{ResultsURL: "https://example.com/chrome-summary.json"},
+		BeforeSummary: map[string][]int{},
+		AfterSummary:  map[string][]int{"/new.html": {1, 1}},
+		Differences:   map[string][]int{"/new.html": {1, 1, 1}},
+	}
+
+	diff, err := d.GetRunsSubtestDiff(summary, DiffFilterParam{Subtests: true}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, fetchedURLs, 1, "should not fetch the side with no summary entry")
+	assert.Equal(t, RunSubtestDiff{"/new.html": {Added: []string{"sub1"}}}, diff)
+}
+
+func TestGetRunsSubtestDiff_NoOpWithoutSubtestsFilter(t *testing.T) {
+	d := diffAPIImpl{ctx: context.Background()}
+	diff, err := d.GetRunsSubtestDiff(RunDiff{}, DiffFilterParam{}, mapset.NewSet())
+	assert.NoError(t, err)
+	assert.Nil(t, diff)
+}